@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +21,49 @@ import (
 
 var modelFilter map[string]struct{}
 
+// usingProviderRegistry is true when main is routing through a multi-backend
+// ProviderRegistry (providers.json present), false for the default
+// single-OpenRouter-backend setup. isModelAllowed needs this because the two
+// paths disagree on what a "full model name" looks like: the registry's is
+// always "<prefix>/<bare-name>", while the single-provider path's is
+// whatever vendor-qualified id the backend's API returned, which
+// models-filter entries (and /api/tags) identify by their short display
+// name instead.
+var usingProviderRegistry bool
+
+// estimateTokenUsage gates the fallback token-count estimate used when a
+// provider doesn't return usage data. Off by default since an estimate is
+// necessarily approximate; set ESTIMATE_TOKEN_USAGE=true to enable it.
+var estimateTokenUsage bool
+
+// estimateTokenCount approximates a token count from raw text using the
+// common ~4-characters-per-token rule of thumb for English text. This proxy
+// has no vendored tokenizer (e.g. tiktoken-go) to call into, so it's a rough
+// stand-in for providers that don't report real usage, used only when
+// estimateTokenUsage is enabled.
+func estimateTokenCount(text string) int {
+	if text == "" {
+		return 0
+	}
+	return (len(text) + 3) / 4
+}
+
+// estimatePromptTokens sums the estimated token count across every message
+// sent to the model, for the same fallback-estimate purpose as
+// estimateTokenCount.
+func estimatePromptTokens(messages []openai.ChatCompletionMessage) int {
+	var total int
+	for _, m := range messages {
+		total += estimateTokenCount(m.Content)
+		for _, part := range m.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeText {
+				total += estimateTokenCount(part.Text)
+			}
+		}
+	}
+	return total
+}
+
 func loadModelFilter(path string) (map[string]struct{}, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -42,20 +88,269 @@ func loadModelFilter(path string) (map[string]struct{}, error) {
 	return filter, nil
 }
 
+// parseOllamaOptions decodes the raw `options` object from an Ollama request
+// into an OllamaOptions struct, warning about any keys we don't recognize
+// instead of failing the request.
+func parseOllamaOptions(raw map[string]interface{}) (OllamaOptions, error) {
+	var options OllamaOptions
+	if len(raw) == 0 {
+		return options, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return options, err
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return options, err
+	}
+
+	WarnUnknownOptions(raw)
+	return options, nil
+}
+
+// ollamaToolCalls converts OpenAI-style tool calls into the shape Ollama
+// clients expect on message.tool_calls. Arguments arrive from the upstream
+// API as a JSON-encoded string; Ollama expects them decoded into an object.
+// Mid-stream deltas can carry partial argument fragments that don't parse as
+// JSON yet, in which case we fall back to passing the raw string through.
+func ollamaToolCalls(toolCalls []openai.ToolCall) []map[string]interface{} {
+	if len(toolCalls) == 0 {
+		return nil
+	}
+
+	calls := make([]map[string]interface{}, 0, len(toolCalls))
+	for _, tc := range toolCalls {
+		var arguments interface{}
+		if err := json.Unmarshal([]byte(tc.Function.Arguments), &arguments); err != nil {
+			arguments = tc.Function.Arguments
+		}
+		calls = append(calls, map[string]interface{}{
+			"function": map[string]interface{}{
+				"name":      tc.Function.Name,
+				"arguments": arguments,
+			},
+		})
+	}
+	return calls
+}
+
+// isModelAllowed applies the models-filter list (if any) to a fully
+// resolved model name, the same way /api/tags does for the model listing.
+// A ProviderRegistry's full names are "<prefix>/<bare-name>" and that's
+// exactly what /api/tags (and so models-filter) lists them as. The default
+// single-provider path's full names are vendor-qualified ids straight from
+// the backend's API, but /api/tags (and models-filter) lists the short
+// display name (the id's last "/"-separated segment) instead, so that's
+// what gets compared against the filter there.
+func isModelAllowed(fullModelName string) bool {
+	if len(modelFilter) == 0 {
+		return true
+	}
+	if usingProviderRegistry {
+		_, ok := modelFilter[fullModelName]
+		return ok
+	}
+	parts := strings.Split(fullModelName, "/")
+	_, ok := modelFilter[parts[len(parts)-1]]
+	return ok
+}
+
+// parseEmbeddingInput normalizes the handful of shapes Ollama/OpenAI clients
+// use for embedding input: Ollama's single `prompt` string, or an `input`
+// field that may be either a single string or an array of strings.
+func parseEmbeddingInput(prompt string, raw json.RawMessage) ([]string, error) {
+	if prompt != "" {
+		return []string{prompt}, nil
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("either 'prompt' or 'input' is required")
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, nil
+	}
+
+	var multi []string
+	if err := json.Unmarshal(raw, &multi); err == nil {
+		return multi, nil
+	}
+
+	return nil, errors.New("'input' must be a string or an array of strings")
+}
+
+// maxImageBytes caps the decoded size of any single image an /api/chat
+// message's `images` array may carry, to keep a misbehaving client from
+// handing us (and the upstream provider) an unbounded payload. Overridable
+// via the MAX_IMAGE_BYTES environment variable.
+var maxImageBytes = 20 * 1024 * 1024
+
+// imageMimeType sniffs the mime type of decoded image bytes from their
+// magic header, the same handful of formats Ollama's `images` field is
+// documented to carry.
+func imageMimeType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png", nil
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg", nil
+	case bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif", nil
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "image/webp", nil
+	default:
+		return "", errors.New("unrecognized image format (expected PNG, JPEG, GIF or WebP)")
+	}
+}
+
+// decodeOllamaImage turns one of an Ollama message's base64-encoded
+// `images` entries into a data: URL OpenRouter's multipart message content
+// accepts, enforcing maxImageBytes and rejecting malformed input outright
+// rather than forwarding it upstream.
+func decodeOllamaImage(encoded string) (string, error) {
+	// Reject oversized payloads by their encoded length before decoding, so
+	// a huge images[] entry can't force a large allocation just to find out
+	// it's over the limit.
+	if base64.StdEncoding.DecodedLen(len(encoded)) > maxImageBytes {
+		return "", fmt.Errorf("image exceeds maximum size of %d bytes", maxImageBytes)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed base64 image data: %w", err)
+	}
+	if len(data) > maxImageBytes {
+		return "", fmt.Errorf("image exceeds maximum size of %d bytes", maxImageBytes)
+	}
+
+	mimeType, err := imageMimeType(data)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, encoded), nil
+}
+
+// ollamaChatMessage mirrors openai.ChatCompletionMessage but additionally
+// accepts Ollama's `images` field (base64-encoded image blobs) so chat
+// messages can carry image attachments the same way Ollama clients send
+// them.
+type ollamaChatMessage struct {
+	Role       string            `json:"role"`
+	Content    string            `json:"content"`
+	Images     []string          `json:"images,omitempty"`
+	ToolCalls  []openai.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+	Name       string            `json:"name,omitempty"`
+}
+
+// toChatCompletionMessages converts the Ollama-shaped request messages into
+// OpenAI's form, rewriting any message carrying `images` into the OpenAI
+// multipart MultiContent shape ({type: "text", ...}, {type: "image_url",
+// ...}) that OpenRouter expects.
+func toChatCompletionMessages(messages []ollamaChatMessage) ([]openai.ChatCompletionMessage, error) {
+	converted := make([]openai.ChatCompletionMessage, 0, len(messages))
+	for _, m := range messages {
+		msg := openai.ChatCompletionMessage{
+			Role:       m.Role,
+			ToolCalls:  m.ToolCalls,
+			ToolCallID: m.ToolCallID,
+			Name:       m.Name,
+		}
+
+		if len(m.Images) == 0 {
+			msg.Content = m.Content
+			converted = append(converted, msg)
+			continue
+		}
+
+		var parts []openai.ChatMessagePart
+		if m.Content != "" {
+			parts = append(parts, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeText,
+				Text: m.Content,
+			})
+		}
+		for _, image := range m.Images {
+			dataURL, err := decodeOllamaImage(image)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: dataURL},
+			})
+		}
+		msg.MultiContent = parts
+		converted = append(converted, msg)
+	}
+	return converted, nil
+}
+
+// writeNDJSONChunk marshals v and writes it to w as a single NDJSON line,
+// flushing immediately so the client sees it as soon as it's produced.
+func writeNDJSONChunk(w http.ResponseWriter, flusher http.Flusher, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// defaultProviderConfigPath is where main looks for a multi-provider setup.
+// Without it, the proxy falls back to a single OpenRouter backend driven by
+// OPENAI_API_KEY/the command-line argument, matching this project's
+// behavior before provider config files existed.
+const defaultProviderConfigPath = "providers.json"
+
+// loadProvider builds the Provider main() routes requests through: a
+// ProviderRegistry from defaultProviderConfigPath if present, otherwise a
+// single OpenAICompatibleProvider pointed at OpenRouter.
+func loadProvider() (Provider, error) {
+	configs, err := loadProviderConfigs(defaultProviderConfigPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("loading %s: %w", defaultProviderConfigPath, err)
+		}
+
+		apiKey := os.Getenv("OPENAI_API_KEY")
+		if apiKey == "" {
+			if len(os.Args) > 1 {
+				apiKey = os.Args[1]
+			} else {
+				return nil, errors.New("OPENAI_API_KEY environment variable or command-line argument not set")
+			}
+		}
+		return NewOpenAICompatibleProvider("openrouter", "https://openrouter.ai/api/v1", apiKey, nil), nil
+	}
+
+	slog.Info("Loaded provider config", "path", defaultProviderConfigPath, "providers", len(configs))
+	return NewProviderRegistry(configs)
+}
+
 func main() {
 	r := gin.Default()
-	// Load the API key from environment variables or command-line arguments.
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		if len(os.Args) > 1 {
-			apiKey = os.Args[1]
+
+	estimateTokenUsage = os.Getenv("ESTIMATE_TOKEN_USAGE") == "true"
+	if raw := os.Getenv("MAX_IMAGE_BYTES"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			maxImageBytes = parsed
 		} else {
-			slog.Error("OPENAI_API_KEY environment variable or command-line argument not set.")
-			return
+			slog.Warn("Ignoring invalid MAX_IMAGE_BYTES value", "value", raw)
 		}
 	}
 
-	provider := NewOpenrouterProvider(apiKey)
+	provider, err := loadProvider()
+	if err != nil {
+		slog.Error("Error setting up providers", "Error", err)
+		return
+	}
+	_, usingProviderRegistry = provider.(*ProviderRegistry)
 
 	filter, err := loadModelFilter("models-filter")
 	if err != nil {
@@ -133,11 +428,98 @@ func main() {
 		c.JSON(http.StatusOK, details)
 	})
 
+	r.POST("/api/embeddings", func(c *gin.Context) {
+		var request struct {
+			Model  string          `json:"model"`
+			Prompt string          `json:"prompt"`
+			Input  json.RawMessage `json:"input"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+			return
+		}
+
+		inputs, err := parseEmbeddingInput(request.Prompt, request.Input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		fullModelName, err := provider.GetFullModelName(request.Model)
+		if err != nil {
+			slog.Error("Error getting full model name", "Error", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if !isModelAllowed(fullModelName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model not found"})
+			return
+		}
+
+		resp, err := provider.Embeddings(fullModelName, inputs)
+		if err != nil {
+			slog.Error("Failed to create embeddings", "Error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(resp.Data) == 1 {
+			c.JSON(http.StatusOK, gin.H{"embedding": resp.Data[0].Embedding})
+			return
+		}
+
+		embeddings := make([][]float32, 0, len(resp.Data))
+		for _, d := range resp.Data {
+			embeddings = append(embeddings, d.Embedding)
+		}
+		c.JSON(http.StatusOK, gin.H{"embeddings": embeddings})
+	})
+
+	r.POST("/v1/embeddings", func(c *gin.Context) {
+		var request struct {
+			Model string          `json:"model"`
+			Input json.RawMessage `json:"input"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+			return
+		}
+
+		inputs, err := parseEmbeddingInput("", request.Input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		fullModelName, err := provider.GetFullModelName(request.Model)
+		if err != nil {
+			slog.Error("Error getting full model name", "Error", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if !isModelAllowed(fullModelName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model not found"})
+			return
+		}
+
+		resp, err := provider.Embeddings(fullModelName, inputs)
+		if err != nil {
+			slog.Error("Failed to create embeddings", "Error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	})
+
 	r.POST("/api/chat", func(c *gin.Context) {
 		var request struct {
-			Model    string                         `json:"model"`
-			Messages []openai.ChatCompletionMessage `json:"messages"`
-			Stream   *bool                          `json:"stream"` // Добавим поле Stream
+			Model      string                 `json:"model"`
+			Messages   []ollamaChatMessage    `json:"messages"`
+			Stream     *bool                  `json:"stream"` // Добавим поле Stream
+			Options    map[string]interface{} `json:"options"`
+			Tools      []openai.Tool          `json:"tools"`
+			ToolChoice interface{}            `json:"tool_choice"`
 		}
 
 		// Parse the JSON request
@@ -146,6 +528,12 @@ func main() {
 			return
 		}
 
+		messages, err := toChatCompletionMessages(request.Messages)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		// Определяем, нужен ли стриминг (по умолчанию true, если не указано для /api/chat)
 		// ВАЖНО: Open WebUI может НЕ передавать "stream": true для /api/chat, подразумевая это.
 		// Нужно проверить, какой запрос шлет Open WebUI. Если не шлет, ставим true.
@@ -154,14 +542,12 @@ func main() {
 			streamRequested = *request.Stream
 		}
 
-		// Если стриминг не запрошен, нужно будет реализовать отдельную логику
-		// для сбора полного ответа и отправки его одним JSON.
-		// Пока реализуем только стриминг.
-		if !streamRequested {
-			// TODO: Реализовать не-потоковый ответ, если нужно
-			c.JSON(http.StatusNotImplemented, gin.H{"error": "Non-streaming response not implemented yet"})
+		options, err := parseOllamaOptions(request.Options)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid options payload"})
 			return
 		}
+		reqOpts := ChatRequestOptions{Options: options, Tools: request.Tools, ToolChoice: request.ToolChoice}
 
 		fullModelName, err := provider.GetFullModelName(request.Model)
 		if err != nil {
@@ -171,8 +557,56 @@ func main() {
 			return
 		}
 
+		requestStart := time.Now()
+
+		if !streamRequested {
+			resp, err := provider.Chat(messages, fullModelName, reqOpts)
+			if err != nil {
+				slog.Error("Failed to create chat completion", "Error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			totalDuration := time.Since(requestStart)
+
+			var content string
+			doneReason := "stop"
+			message := gin.H{"role": "assistant", "content": ""}
+			if len(resp.Choices) > 0 {
+				content = resp.Choices[0].Message.Content
+				message["content"] = content
+				if toolCalls := ollamaToolCalls(resp.Choices[0].Message.ToolCalls); toolCalls != nil {
+					message["tool_calls"] = toolCalls
+				}
+				if resp.Choices[0].FinishReason != "" {
+					doneReason = string(resp.Choices[0].FinishReason)
+				}
+			}
+
+			promptTokens := resp.Usage.PromptTokens
+			evalTokens := resp.Usage.CompletionTokens
+			if promptTokens == 0 && evalTokens == 0 && estimateTokenUsage {
+				promptTokens = estimatePromptTokens(messages)
+				evalTokens = estimateTokenCount(content)
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"model":                fullModelName,
+				"created_at":           time.Now().Format(time.RFC3339),
+				"message":              message,
+				"done":                 true,
+				"done_reason":          doneReason,
+				"total_duration":       totalDuration.Nanoseconds(),
+				"load_duration":        0,
+				"prompt_eval_count":    promptTokens,
+				"prompt_eval_duration": 0,
+				"eval_count":           evalTokens,
+				"eval_duration":        totalDuration.Nanoseconds(),
+			})
+			return
+		}
+
 		// Call ChatStream to get the stream
-		stream, err := provider.ChatStream(request.Messages, fullModelName)
+		stream, err := provider.ChatStream(messages, fullModelName, reqOpts)
 		if err != nil {
 			slog.Error("Failed to create stream", "Error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -197,6 +631,9 @@ func main() {
 		}
 
 		var lastFinishReason string
+		var usage *openai.Usage
+		var firstTokenTime, lastTokenTime time.Time
+		var aggregatedContent strings.Builder
 
 		// Stream responses back to the client
 		for {
@@ -216,34 +653,49 @@ func main() {
 				return
 			}
 
+			// With stream_options.include_usage set, the backend sends a
+			// final chunk carrying only usage and an empty Choices array.
+			if response.Usage != nil {
+				usage = response.Usage
+			}
+			if len(response.Choices) == 0 {
+				continue
+			}
+
 			// Сохраняем причину остановки, если она есть в чанке
-			if len(response.Choices) > 0 && response.Choices[0].FinishReason != "" {
+			if response.Choices[0].FinishReason != "" {
 				lastFinishReason = string(response.Choices[0].FinishReason)
 			}
 
+			delta := response.Choices[0].Delta
+			if delta.Content != "" || len(delta.ToolCalls) > 0 {
+				now := time.Now()
+				if firstTokenTime.IsZero() {
+					firstTokenTime = now
+				}
+				lastTokenTime = now
+				aggregatedContent.WriteString(delta.Content)
+			}
+
 			// Build JSON response structure for intermediate chunks (Ollama chat format)
+			message := map[string]interface{}{
+				"role":    "assistant",
+				"content": delta.Content, // Может быть ""
+			}
+			if toolCalls := ollamaToolCalls(delta.ToolCalls); toolCalls != nil {
+				message["tool_calls"] = toolCalls
+			}
 			responseJSON := map[string]interface{}{
 				"model":      fullModelName,
 				"created_at": time.Now().Format(time.RFC3339),
-				"message": map[string]string{
-					"role":    "assistant",
-					"content": response.Choices[0].Delta.Content, // Может быть ""
-				},
-				"done": false, // Всегда false для промежуточных чанков
+				"message":    message,
+				"done":       false, // Всегда false для промежуточных чанков
 			}
 
-			// Marshal JSON
-			jsonData, err := json.Marshal(responseJSON)
-			if err != nil {
-				slog.Error("Error marshaling intermediate response JSON", "Error", err)
-				return // Прерываем, так как не можем отправить данные
+			if err := writeNDJSONChunk(w, flusher, responseJSON); err != nil {
+				slog.Error("Error writing intermediate response chunk", "Error", err)
+				return
 			}
-
-			// Send JSON object followed by a newline
-			fmt.Fprintf(w, "%s\n", string(jsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON (JSON + \n)
-
-			// Flush data to send it immediately
-			flusher.Flush()
 		}
 
 		// --- Отправка финального сообщения (done: true) в стиле Ollama ---
@@ -254,29 +706,42 @@ func main() {
 			lastFinishReason = "stop"
 		}
 
-		// ВАЖНО: Замените nil на 0 для числовых полей статистики
+		totalDuration := time.Since(requestStart)
+		var promptEvalDuration, evalDuration time.Duration
+		if !firstTokenTime.IsZero() {
+			promptEvalDuration = firstTokenTime.Sub(requestStart)
+			evalDuration = lastTokenTime.Sub(firstTokenTime)
+		} else {
+			evalDuration = totalDuration
+		}
+
+		var promptTokens, evalTokens int
+		if usage != nil {
+			promptTokens = usage.PromptTokens
+			evalTokens = usage.CompletionTokens
+		} else if estimateTokenUsage {
+			promptTokens = estimatePromptTokens(messages)
+			evalTokens = estimateTokenCount(aggregatedContent.String())
+		}
+
 		finalResponse := map[string]interface{}{
-			"model":             fullModelName,
-			"created_at":        time.Now().Format(time.RFC3339),
-			"done":              true,
-			"finish_reason":     lastFinishReason, // Необязательно для /api/chat Ollama, но не вредит
-			"total_duration":    0,
-			"load_duration":     0,
-			"prompt_eval_count": 0, // <--- ИЗМЕНЕНО: nil заменен на 0
-			"eval_count":        0, // <--- ИЗМЕНЕНО: nil заменен на 0
-			"eval_duration":     0,
+			"model":                fullModelName,
+			"created_at":           time.Now().Format(time.RFC3339),
+			"done":                 true,
+			"done_reason":          lastFinishReason,
+			"total_duration":       totalDuration.Nanoseconds(),
+			"load_duration":        0,
+			"prompt_eval_count":    promptTokens,
+			"prompt_eval_duration": promptEvalDuration.Nanoseconds(),
+			"eval_count":           evalTokens,
+			"eval_duration":        evalDuration.Nanoseconds(),
 		}
 
-		finalJsonData, err := json.Marshal(finalResponse)
-		if err != nil {
-			slog.Error("Error marshaling final response JSON", "Error", err)
+		if err := writeNDJSONChunk(w, flusher, finalResponse); err != nil {
+			slog.Error("Error writing final response chunk", "Error", err)
 			return
 		}
 
-		// Отправляем финальный JSON-объект + newline
-		fmt.Fprintf(w, "%s\n", string(finalJsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON
-		flusher.Flush()
-
 		// ВАЖНО: Для NDJSON НЕТ 'data: [DONE]' маркера.
 		// Клиент понимает конец потока по получению объекта с "done": true
 		// и/или по закрытию соединения сервером (что Gin сделает автоматически после выхода из хендлера).
@@ -284,5 +749,176 @@ func main() {
 		// --- Конец исправлений ---
 	})
 
+	r.POST("/api/generate", func(c *gin.Context) {
+		var request struct {
+			Model    string                 `json:"model"`
+			Prompt   string                 `json:"prompt"`
+			System   string                 `json:"system"`
+			Template string                 `json:"template"`
+			Context  []int                  `json:"context"`
+			Stream   *bool                  `json:"stream"`
+			Options  map[string]interface{} `json:"options"`
+		}
+
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+			return
+		}
+
+		streamRequested := true
+		if request.Stream != nil {
+			streamRequested = *request.Stream
+		}
+
+		options, err := parseOllamaOptions(request.Options)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid options payload"})
+			return
+		}
+
+		fullModelName, err := provider.GetFullModelName(request.Model)
+		if err != nil {
+			slog.Error("Error getting full model name", "Error", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		var messages []openai.ChatCompletionMessage
+		if request.System != "" {
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: request.System,
+			})
+		}
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: request.Prompt,
+		})
+
+		// The context field is opaque to us; Ollama clients only care that
+		// whatever they sent comes back so they can resend it on the next turn.
+		responseContext := request.Context
+		if responseContext == nil {
+			responseContext = []int{}
+		}
+
+		reqOpts := ChatRequestOptions{Options: options}
+
+		if !streamRequested {
+			resp, err := provider.Chat(messages, fullModelName, reqOpts)
+			if err != nil {
+				slog.Error("Failed to create chat completion", "Error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			var content string
+			doneReason := "stop"
+			if len(resp.Choices) > 0 {
+				content = resp.Choices[0].Message.Content
+				if resp.Choices[0].FinishReason != "" {
+					doneReason = string(resp.Choices[0].FinishReason)
+				}
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"model":                fullModelName,
+				"created_at":           time.Now().Format(time.RFC3339),
+				"response":             content,
+				"done":                 true,
+				"done_reason":          doneReason,
+				"context":              responseContext,
+				"total_duration":       0,
+				"load_duration":        0,
+				"prompt_eval_count":    0,
+				"prompt_eval_duration": 0,
+				"eval_count":           0,
+				"eval_duration":        0,
+			})
+			return
+		}
+
+		stream, err := provider.ChatStream(messages, fullModelName, reqOpts)
+		if err != nil {
+			slog.Error("Failed to create stream", "Error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer stream.Close()
+
+		c.Writer.Header().Set("Content-Type", "application/x-ndjson")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+
+		w := c.Writer
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			slog.Error("Expected http.ResponseWriter to be an http.Flusher")
+			return
+		}
+
+		var lastFinishReason string
+
+		for {
+			response, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				slog.Error("Backend stream error", "Error", err)
+				errorMsg := map[string]string{"error": "Stream error: " + err.Error()}
+				errorJson, _ := json.Marshal(errorMsg)
+				fmt.Fprintf(w, "%s\n", string(errorJson))
+				flusher.Flush()
+				return
+			}
+
+			// With stream_options.include_usage set, the backend sends a
+			// final chunk carrying only usage and an empty Choices array.
+			if len(response.Choices) == 0 {
+				continue
+			}
+
+			if response.Choices[0].FinishReason != "" {
+				lastFinishReason = string(response.Choices[0].FinishReason)
+			}
+
+			responseJSON := map[string]interface{}{
+				"model":      fullModelName,
+				"created_at": time.Now().Format(time.RFC3339),
+				"response":   response.Choices[0].Delta.Content,
+				"done":       false,
+			}
+
+			if err := writeNDJSONChunk(w, flusher, responseJSON); err != nil {
+				slog.Error("Error writing intermediate response chunk", "Error", err)
+				return
+			}
+		}
+
+		if lastFinishReason == "" {
+			lastFinishReason = "stop"
+		}
+
+		finalResponse := map[string]interface{}{
+			"model":             fullModelName,
+			"created_at":        time.Now().Format(time.RFC3339),
+			"response":          "",
+			"done":              true,
+			"done_reason":       lastFinishReason,
+			"context":           responseContext,
+			"total_duration":    0,
+			"load_duration":     0,
+			"prompt_eval_count": 0,
+			"eval_count":        0,
+			"eval_duration":     0,
+		}
+
+		if err := writeNDJSONChunk(w, flusher, finalResponse); err != nil {
+			slog.Error("Error writing final response chunk", "Error", err)
+			return
+		}
+	})
+
 	r.Run(":11434")
 }
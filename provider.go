@@ -1,62 +1,371 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
 
-type OpenrouterProvider struct {
-	client     *openai.Client
-	modelNames []string // Shared storage for model names
+type OpenAICompatibleProvider struct {
+	name           string
+	client         *openai.Client
+	baseURL        string
+	apiKey         string
+	defaultHeaders map[string]string
+	modelNames     []string // Shared storage for model names
 }
 
-func NewOpenrouterProvider(baseUrl string, apiKey string) *OpenrouterProvider {
+// headerInjectingTransport adds a fixed set of headers to every outgoing
+// request before delegating to the wrapped RoundTripper. Used to forward a
+// provider's `default_headers` config (e.g. OpenRouter's HTTP-Referer/
+// X-Title attribution headers) through the go-openai client, which has no
+// first-class way to set arbitrary headers.
+type headerInjectingTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerInjectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// NewOpenAICompatibleProvider builds a provider that talks to any
+// OpenAI-compatible chat completions API (OpenRouter, Groq, Together,
+// DeepInfra, a local vLLM/LocalAI instance, ...) at baseUrl.
+func NewOpenAICompatibleProvider(name string, baseUrl string, apiKey string, defaultHeaders map[string]string) *OpenAICompatibleProvider {
 	config := openai.DefaultConfig(apiKey)
 	config.BaseURL = baseUrl
-	return &OpenrouterProvider{
-		client:     openai.NewClientWithConfig(config),
-		modelNames: []string{},
+	if len(defaultHeaders) > 0 {
+		config.HTTPClient = &http.Client{
+			Transport: &headerInjectingTransport{headers: defaultHeaders, base: http.DefaultTransport},
+		}
+	}
+	return &OpenAICompatibleProvider{
+		name:           name,
+		client:         openai.NewClientWithConfig(config),
+		baseURL:        baseUrl,
+		apiKey:         apiKey,
+		defaultHeaders: defaultHeaders,
+		modelNames:     []string{},
+	}
+}
+
+// OllamaOptions mirrors the `options` object Ollama clients send on
+// /api/chat and /api/generate requests. Fields are pointers so we can tell
+// "not set" apart from the zero value.
+type OllamaOptions struct {
+	Temperature      *float32 `json:"temperature"`
+	TopP             *float32 `json:"top_p"`
+	TopK             *int     `json:"top_k"`
+	NumPredict       *int     `json:"num_predict"`
+	RepeatPenalty    *float32 `json:"repeat_penalty"`
+	PresencePenalty  *float32 `json:"presence_penalty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty"`
+	Seed             *int     `json:"seed"`
+	Stop             []string `json:"stop"`
+	Mirostat         *int     `json:"mirostat"`
+	MirostatEta      *float32 `json:"mirostat_eta"`
+	MirostatTau      *float32 `json:"mirostat_tau"`
+	NumCtx           *int     `json:"num_ctx"`
+	MinP             *float32 `json:"min_p"`
+}
+
+// knownOptionKeys is used to warn about options we don't recognize instead
+// of silently dropping them.
+var knownOptionKeys = map[string]struct{}{
+	"temperature":       {},
+	"top_p":             {},
+	"top_k":             {},
+	"num_predict":       {},
+	"repeat_penalty":    {},
+	"presence_penalty":  {},
+	"frequency_penalty": {},
+	"seed":              {},
+	"stop":              {},
+	"mirostat":          {},
+	"mirostat_eta":      {},
+	"mirostat_tau":      {},
+	"num_ctx":           {},
+	"min_p":             {},
+}
+
+// applyOptions copies the fields of opts that map directly onto
+// openai.ChatCompletionRequest and returns the remainder (OpenRouter-specific
+// parameters with no equivalent in the OpenAI schema) to be forwarded as
+// extra body fields.
+func applyOptions(req *openai.ChatCompletionRequest, opts OllamaOptions) map[string]interface{} {
+	extra := map[string]interface{}{}
+
+	if opts.Temperature != nil {
+		req.Temperature = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		req.TopP = *opts.TopP
+	}
+	if opts.NumPredict != nil && *opts.NumPredict > 0 {
+		req.MaxTokens = *opts.NumPredict
+	}
+	if opts.Stop != nil {
+		req.Stop = opts.Stop
+	}
+	if opts.PresencePenalty != nil {
+		req.PresencePenalty = *opts.PresencePenalty
+	}
+	if opts.FrequencyPenalty != nil {
+		req.FrequencyPenalty = *opts.FrequencyPenalty
+	}
+	if opts.Seed != nil {
+		req.Seed = opts.Seed
+	}
+
+	// These don't exist on openai.ChatCompletionRequest; OpenRouter accepts
+	// them as plain top-level fields in the request body, so stash them for
+	// the raw-HTTP fallback below.
+	if opts.TopK != nil {
+		extra["top_k"] = *opts.TopK
+	}
+	if opts.RepeatPenalty != nil {
+		extra["repetition_penalty"] = *opts.RepeatPenalty
+	}
+	if opts.MinP != nil {
+		extra["min_p"] = *opts.MinP
+	}
+	if opts.Mirostat != nil {
+		extra["mirostat"] = *opts.Mirostat
+	}
+	if opts.MirostatEta != nil {
+		extra["mirostat_eta"] = *opts.MirostatEta
+	}
+	if opts.MirostatTau != nil {
+		extra["mirostat_tau"] = *opts.MirostatTau
+	}
+	if opts.NumCtx != nil {
+		extra["num_ctx"] = *opts.NumCtx
 	}
+
+	return extra
+}
+
+// WarnUnknownOptions logs (but does not fail on) any key in rawOptions that
+// we don't know how to translate.
+func WarnUnknownOptions(rawOptions map[string]interface{}) {
+	for key := range rawOptions {
+		if _, ok := knownOptionKeys[key]; !ok {
+			slog.Warn("Ignoring unknown Ollama option", "key", key)
+		}
+	}
+}
+
+// ChatRequestOptions bundles everything an Ollama request can attach to a
+// chat completion beyond the message list itself.
+type ChatRequestOptions struct {
+	Options    OllamaOptions
+	Tools      []openai.Tool
+	ToolChoice interface{}
 }
 
-func (o *OpenrouterProvider) Chat(messages []openai.ChatCompletionMessage, modelName string) (openai.ChatCompletionResponse, error) {
+func (o *OpenAICompatibleProvider) Chat(messages []openai.ChatCompletionMessage, modelName string, reqOpts ChatRequestOptions) (openai.ChatCompletionResponse, error) {
 	// Create a chat completion request
 	req := openai.ChatCompletionRequest{
-		Model:    modelName,
-		Messages: messages,
-		Stream:   false,
+		Model:      modelName,
+		Messages:   messages,
+		Stream:     false,
+		Tools:      reqOpts.Tools,
+		ToolChoice: reqOpts.ToolChoice,
 	}
+	extra := applyOptions(&req, reqOpts.Options)
 
-	// Call the OpenAI API to get a complete response
-	resp, err := o.client.CreateChatCompletion(context.Background(), req)
-	if err != nil {
-		return openai.ChatCompletionResponse{}, err
+	if len(extra) == 0 {
+		// Call the OpenAI API to get a complete response
+		resp, err := o.client.CreateChatCompletion(context.Background(), req)
+		if err != nil {
+			return openai.ChatCompletionResponse{}, err
+		}
+		return resp, nil
 	}
 
-	// Return the complete response
-	return resp, nil
+	return o.createChatCompletionWithExtra(req, extra)
 }
 
-func (o *OpenrouterProvider) ChatStream(messages []openai.ChatCompletionMessage, modelName string) (*openai.ChatCompletionStream, error) {
+func (o *OpenAICompatibleProvider) ChatStream(messages []openai.ChatCompletionMessage, modelName string, reqOpts ChatRequestOptions) (ChatStream, error) {
 	// Create a chat completion request
 	req := openai.ChatCompletionRequest{
-		Model:    modelName,
-		Messages: messages,
-		Stream:   true,
+		Model:      modelName,
+		Messages:   messages,
+		Stream:     true,
+		Tools:      reqOpts.Tools,
+		ToolChoice: reqOpts.ToolChoice,
+		// Ask for a final usage-bearing chunk so /api/chat can report real
+		// prompt/completion token counts instead of zeros.
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
+	}
+	extra := applyOptions(&req, reqOpts.Options)
+
+	if len(extra) == 0 {
+		// Call the OpenAI API to get a streaming response
+		stream, err := o.client.CreateChatCompletionStream(context.Background(), req)
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	return o.createChatCompletionStreamWithExtra(req, extra)
+}
+
+// ChatStream is satisfied by both *openai.ChatCompletionStream and our
+// raw-HTTP fallback, so callers don't need to care which one produced it.
+type ChatStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// mergeExtraBody marshals req the same way the OpenAI client would, then
+// merges in fields OpenRouter understands but go-openai's request struct
+// doesn't model (top_k, repetition_penalty, min_p, mirostat*, ...).
+func mergeExtraBody(req openai.ChatCompletionRequest, extra map[string]interface{}) ([]byte, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged map[string]interface{}
+	if err := json.Unmarshal(reqBytes, &merged); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+
+	return json.Marshal(merged)
+}
+
+func (o *OpenAICompatibleProvider) newChatCompletionsRequest(body []byte) (*http.Request, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimRight(o.baseURL, "/")+"/chat/completions", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+o.apiKey)
+	for k, v := range o.defaultHeaders {
+		httpReq.Header.Set(k, v)
+	}
+	return httpReq, nil
+}
+
+func (o *OpenAICompatibleProvider) createChatCompletionWithExtra(req openai.ChatCompletionRequest, extra map[string]interface{}) (openai.ChatCompletionResponse, error) {
+	body, err := mergeExtraBody(req, extra)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	httpReq, err := o.newChatCompletionsRequest(body)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		data, _ := io.ReadAll(resp.Body)
+		return openai.ChatCompletionResponse{}, fmt.Errorf("chat completion request failed: %s: %s", resp.Status, string(data))
+	}
+
+	var result openai.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	return result, nil
+}
+
+// rawSSEStream reads an OpenAI-compatible Server-Sent-Events chat completion
+// stream directly, for requests whose extra body fields fall outside what
+// the go-openai client can send.
+type rawSSEStream struct {
+	resp   *http.Response
+	reader *bufio.Reader
+}
+
+func (s *rawSSEStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return openai.ChatCompletionStreamResponse{}, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		payload := strings.TrimPrefix(line, "data: ")
+		if payload == "[DONE]" {
+			return openai.ChatCompletionStreamResponse{}, io.EOF
+		}
+
+		var chunk openai.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			return openai.ChatCompletionStreamResponse{}, err
+		}
+		return chunk, nil
+	}
+}
+
+func (s *rawSSEStream) Close() error {
+	return s.resp.Body.Close()
+}
+
+func (o *OpenAICompatibleProvider) createChatCompletionStreamWithExtra(req openai.ChatCompletionRequest, extra map[string]interface{}) (ChatStream, error) {
+	body, err := mergeExtraBody(req, extra)
+	if err != nil {
+		return nil, err
 	}
 
-	// Call the OpenAI API to get a streaming response
-	stream, err := o.client.CreateChatCompletionStream(context.Background(), req)
+	httpReq, err := o.newChatCompletionsRequest(body)
 	if err != nil {
 		return nil, err
 	}
+	httpReq.Header.Set("Accept", "text/event-stream")
 
-	// Return the stream for further processing
-	return stream, nil
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("chat completion stream request failed: %s: %s", resp.Status, string(data))
+	}
+
+	return &rawSSEStream{resp: resp, reader: bufio.NewReader(resp.Body)}, nil
+}
+
+func (o *OpenAICompatibleProvider) Embeddings(modelName string, input []string) (openai.EmbeddingResponse, error) {
+	req := openai.EmbeddingRequest{
+		Model: openai.EmbeddingModel(modelName),
+		Input: input,
+	}
+
+	resp, err := o.client.CreateEmbeddings(context.Background(), req)
+	if err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+	return resp, nil
 }
 
 type ModelDetails struct {
@@ -77,7 +386,7 @@ type Model struct {
 	Details    ModelDetails `json:"details,omitempty"`
 }
 
-func (o *OpenrouterProvider) GetModels() ([]Model, error) {
+func (o *OpenAICompatibleProvider) GetModels() ([]Model, error) {
 	currentTime := time.Now().Format(time.RFC3339)
 
 	// Fetch models from the OpenAI API
@@ -120,7 +429,7 @@ func (o *OpenrouterProvider) GetModels() ([]Model, error) {
 	return models, nil
 }
 
-func (o *OpenrouterProvider) GetModelDetails(modelName string) (map[string]interface{}, error) {
+func (o *OpenAICompatibleProvider) GetModelDetails(modelName string) (map[string]interface{}, error) {
 	// Stub response; replace with actual model details if available
 	currentTime := time.Now().Format(time.RFC3339)
 	return map[string]interface{}{
@@ -140,30 +449,40 @@ func (o *OpenrouterProvider) GetModelDetails(modelName string) (map[string]inter
 	}, nil
 }
 
-func (o *OpenrouterProvider) GetFullModelName(alias string) (string, error) {
+func (o *OpenAICompatibleProvider) GetFullModelName(alias string) (string, error) {
+	fullName, _, err := o.ResolveModelName(alias)
+	return fullName, err
+}
+
+// ResolveModelName is GetFullModelName plus an explicit found flag, so
+// callers (notably ProviderRegistry, which tries several providers in turn)
+// can tell "alias is this provider's own full model name" apart from
+// "alias wasn't recognized, echoed back unchanged" without relying on
+// string equality against the input as a proxy for "not found".
+func (o *OpenAICompatibleProvider) ResolveModelName(alias string) (string, bool, error) {
 	// If modelNames is empty or not populated yet, try to get models first
 	if len(o.modelNames) == 0 {
 		_, err := o.GetModels()
 		if err != nil {
-			return "", fmt.Errorf("failed to get models: %w", err)
+			return "", false, fmt.Errorf("failed to get models: %w", err)
 		}
 	}
 
 	// First try exact match
 	for _, fullName := range o.modelNames {
 		if fullName == alias {
-			return fullName, nil
+			return fullName, true, nil
 		}
 	}
 
 	// Then try suffix match
 	for _, fullName := range o.modelNames {
 		if strings.HasSuffix(fullName, alias) {
-			return fullName, nil
+			return fullName, true, nil
 		}
 	}
 
 	// If no match found, just use the alias as is
 	// This allows direct use of model names that might not be in the list
-	return alias, nil
+	return alias, false, nil
 }
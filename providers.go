@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Provider is the seam between the Ollama-shaped HTTP handlers and whatever
+// backend actually serves completions. OpenAICompatibleProvider is the only
+// implementation today, but the interface lets ProviderRegistry (and future
+// backends, e.g. a native Anthropic client) be swapped in without touching
+// main.go's route handlers.
+type Provider interface {
+	GetModels() ([]Model, error)
+	GetModelDetails(modelName string) (map[string]interface{}, error)
+	Chat(messages []openai.ChatCompletionMessage, modelName string, reqOpts ChatRequestOptions) (openai.ChatCompletionResponse, error)
+	ChatStream(messages []openai.ChatCompletionMessage, modelName string, reqOpts ChatRequestOptions) (ChatStream, error)
+	Embeddings(modelName string, input []string) (openai.EmbeddingResponse, error)
+	GetFullModelName(alias string) (string, error)
+	// ResolveModelName is GetFullModelName plus an explicit found flag, so
+	// callers that try several providers in turn (ProviderRegistry) can
+	// tell "this is the provider's own full model name" apart from "not
+	// recognized, echoed back unchanged" without guessing from string
+	// equality against the input.
+	ResolveModelName(alias string) (fullName string, found bool, err error)
+}
+
+// ProviderConfig describes one backend entry in the providers config file.
+// ModelPrefix defaults to Name when empty, and is what gets prepended to
+// that provider's model names in the unioned /api/tags listing (e.g.
+// "groq/llama-3.1-70b"), so /api/chat can route a request back to the right
+// backend.
+type ProviderConfig struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	BaseURL        string            `json:"base_url"`
+	APIKeyEnv      string            `json:"api_key_env"`
+	DefaultHeaders map[string]string `json:"default_headers"`
+	ModelPrefix    string            `json:"model_prefix"`
+}
+
+// loadProviderConfigs reads a JSON array of ProviderConfig entries from
+// path. A YAML file would do just as well here, but the project has no
+// existing YAML dependency, so the config format stays JSON like every
+// other file this proxy reads or writes.
+func loadProviderConfigs(path string) ([]ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []ProviderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// buildProvider constructs the Provider named by cfg.Type. "openai-compatible"
+// (the default when Type is empty) covers OpenRouter, Groq, Together,
+// DeepInfra, local vLLM/LocalAI, and anything else that speaks the OpenAI
+// chat completions API.
+func buildProvider(cfg ProviderConfig) (Provider, error) {
+	apiKey := os.Getenv(cfg.APIKeyEnv)
+	if apiKey == "" && cfg.APIKeyEnv != "" {
+		return nil, fmt.Errorf("provider %q: environment variable %q is not set", cfg.Name, cfg.APIKeyEnv)
+	}
+
+	switch cfg.Type {
+	case "", "openai-compatible":
+		return NewOpenAICompatibleProvider(cfg.Name, cfg.BaseURL, apiKey, cfg.DefaultHeaders), nil
+	default:
+		return nil, fmt.Errorf("provider %q: unknown type %q", cfg.Name, cfg.Type)
+	}
+}
+
+// registeredProvider pairs a backend with the prefix its model names are
+// exposed under.
+type registeredProvider struct {
+	prefix   string
+	provider Provider
+}
+
+// ProviderRegistry unions several backends behind a single Provider, routing
+// each call by the "<prefix>/<model>" convention established in GetModels.
+// It satisfies the Provider interface itself, so main.go's handlers don't
+// need to know whether they're talking to one backend or several.
+type ProviderRegistry struct {
+	providers []registeredProvider
+}
+
+// NewProviderRegistry builds one backend per entry in configs, in order.
+func NewProviderRegistry(configs []ProviderConfig) (*ProviderRegistry, error) {
+	reg := &ProviderRegistry{}
+	for _, cfg := range configs {
+		provider, err := buildProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		prefix := cfg.ModelPrefix
+		if prefix == "" {
+			prefix = cfg.Name
+		}
+		reg.providers = append(reg.providers, registeredProvider{prefix: prefix, provider: provider})
+	}
+	return reg, nil
+}
+
+// resolve splits a prefixed model name ("groq/llama-3.1-70b") into the
+// backend that owns it and the bare name that backend understands. If
+// fullModelName doesn't carry a recognized prefix, it's handed as-is to the
+// first configured provider, preserving the single-backend behavior this
+// proxy had before providers.go existed.
+func (r *ProviderRegistry) resolve(fullModelName string) (Provider, string, error) {
+	if len(r.providers) == 0 {
+		return nil, "", fmt.Errorf("no providers configured")
+	}
+
+	if prefix, rest, ok := strings.Cut(fullModelName, "/"); ok {
+		for _, rp := range r.providers {
+			if rp.prefix == prefix {
+				return rp.provider, rest, nil
+			}
+		}
+	}
+
+	return r.providers[0].provider, fullModelName, nil
+}
+
+func (r *ProviderRegistry) GetModels() ([]Model, error) {
+	var all []Model
+	for _, rp := range r.providers {
+		models, err := rp.provider.GetModels()
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", rp.prefix, err)
+		}
+		for _, m := range models {
+			prefixed := rp.prefix + "/" + m.Model
+			m.Name = prefixed
+			m.Model = prefixed
+			all = append(all, m)
+		}
+	}
+	return all, nil
+}
+
+func (r *ProviderRegistry) GetModelDetails(modelName string) (map[string]interface{}, error) {
+	provider, bareName, err := r.resolve(modelName)
+	if err != nil {
+		return nil, err
+	}
+	return provider.GetModelDetails(bareName)
+}
+
+func (r *ProviderRegistry) Chat(messages []openai.ChatCompletionMessage, modelName string, reqOpts ChatRequestOptions) (openai.ChatCompletionResponse, error) {
+	provider, bareName, err := r.resolve(modelName)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	return provider.Chat(messages, bareName, reqOpts)
+}
+
+func (r *ProviderRegistry) ChatStream(messages []openai.ChatCompletionMessage, modelName string, reqOpts ChatRequestOptions) (ChatStream, error) {
+	provider, bareName, err := r.resolve(modelName)
+	if err != nil {
+		return nil, err
+	}
+	return provider.ChatStream(messages, bareName, reqOpts)
+}
+
+func (r *ProviderRegistry) Embeddings(modelName string, input []string) (openai.EmbeddingResponse, error) {
+	provider, bareName, err := r.resolve(modelName)
+	if err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+	return provider.Embeddings(bareName, input)
+}
+
+// GetFullModelName resolves alias to a "<prefix>/<full-name>" model name.
+// See ResolveModelName for how unprefixed aliases are matched against each
+// provider in turn; if none match, the alias is returned as-is under the
+// first provider's prefix so direct model names not present in any listing
+// can still be used.
+func (r *ProviderRegistry) GetFullModelName(alias string) (string, error) {
+	fullName, _, err := r.ResolveModelName(alias)
+	return fullName, err
+}
+
+// ResolveModelName is GetFullModelName plus an explicit found flag. If
+// alias already carries a recognized prefix, resolution is delegated to
+// that provider alone. Otherwise every provider is tried in config order,
+// via that provider's own (cached) ResolveModelName, and the first one
+// reporting found=true wins — checking that flag instead of comparing the
+// resolved name against alias, since a provider whose own full model name
+// happens to equal alias verbatim would otherwise be indistinguishable from
+// a provider that didn't recognize it at all.
+func (r *ProviderRegistry) ResolveModelName(alias string) (string, bool, error) {
+	if len(r.providers) == 0 {
+		return "", false, fmt.Errorf("no providers configured")
+	}
+
+	if prefix, rest, ok := strings.Cut(alias, "/"); ok {
+		for _, rp := range r.providers {
+			if rp.prefix == prefix {
+				fullName, found, err := rp.provider.ResolveModelName(rest)
+				if err != nil {
+					return "", false, err
+				}
+				return rp.prefix + "/" + fullName, found, nil
+			}
+		}
+	}
+
+	for _, rp := range r.providers {
+		fullName, found, err := rp.provider.ResolveModelName(alias)
+		if err != nil {
+			continue
+		}
+		if found {
+			return rp.prefix + "/" + fullName, true, nil
+		}
+	}
+
+	return r.providers[0].prefix + "/" + alias, false, nil
+}